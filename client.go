@@ -3,6 +3,7 @@ package rtmp
 import (
 	"bytes"
 	"code.google.com/p/go-uuid/uuid"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"sync"
 	"sync/atomic"
 )
 
@@ -18,6 +20,7 @@ type ClientHandler interface {
 	OnConnect()
 	OnDisconnect()
 	OnReceive(message *Message)
+	OnStatus(code string, info amf.Object)
 }
 
 type Client struct {
@@ -28,11 +31,16 @@ type Client struct {
 
 	conn net.Conn
 
-	outBytes        uint32
-	outMessages     chan *Message
-	outWindowSize   uint32
-	outChunkSize    uint32
-	outChunkStreams map[uint32]*OutboundChunkStream
+	outBytes          uint32
+	outMessages       chan *Message
+	outWindowSize     uint32
+	outChunkSize      uint32
+	outChunkStreamsMu sync.Mutex
+	outChunkStreams   map[uint32]*OutboundChunkStream
+
+	outQueuesMu sync.Mutex
+	outQueues   map[uint32]*outboundQueue
+	sendSignal  chan struct{}
 
 	inBytes        uint32
 	inMessages     chan *Message
@@ -42,6 +50,23 @@ type Client struct {
 	inChunkStreams map[uint32]*InboundChunkStream
 
 	lastTransactionId uint32
+	lastChunkStreamId uint32
+
+	lastAckSent    uint32
+	peerAckedBytes uint32
+	sendResume     chan struct{}
+
+	pendingMu       sync.Mutex
+	pendingCommands map[uint32]*pendingCommand
+
+	pushMu       sync.Mutex
+	pushHandlers map[string]CommandHandler
+
+	streams map[uint32]*NetStream
+
+	videoConfig *AVCDecoderConfigurationRecord
+	audioConfig *AudioSpecificConfig
+	flvTags     chan *FLVTag
 }
 
 func NewClient(url string) (*Client, error) {
@@ -55,12 +80,28 @@ func NewClient(url string) (*Client, error) {
 		outWindowSize:   DEFAULT_WINDOW_SIZE,
 		outChunkStreams: make(map[uint32]*OutboundChunkStream),
 
+		outQueues:  make(map[uint32]*outboundQueue),
+		sendSignal: make(chan struct{}, 1),
+
 		inMessages:     make(chan *Message, 100),
 		inChunkSize:    DEFAULT_CHUNK_SIZE,
 		inWindowSize:   DEFAULT_WINDOW_SIZE,
 		inChunkStreams: make(map[uint32]*InboundChunkStream),
+
+		lastChunkStreamId: CHUNK_STREAM_ID_USER_CONTROL,
+
+		sendResume: make(chan struct{}, 1),
+
+		pendingCommands: make(map[uint32]*pendingCommand),
+		pushHandlers:    make(map[string]CommandHandler),
+
+		streams: make(map[uint32]*NetStream),
+
+		flvTags: make(chan *FLVTag, MESSAGE_DISPATCH_QUEUE_LENGTH),
 	}
 
+	c.HandleCommand("onStatus", c.onStatus)
+
 	err := c.Connect()
 	if err != nil {
 		return c, err
@@ -92,15 +133,16 @@ func (c *Client) Connect() (err error) {
 		return err
 	}
 
+	go c.dispatchLoop()
+	go c.receiveLoop()
+	go c.dispatchOutbound()
+	go c.sendLoop()
+
 	err = c.connectCommand()
 	if err != nil {
 		return err
 	}
 
-	go c.dispatchLoop()
-	go c.receiveLoop()
-	go c.sendLoop()
-
 	log.Info("connected to %s", c.url)
 
 	return nil
@@ -110,12 +152,23 @@ func (c *Client) NextTransactionId() uint32 {
 	return atomic.AddUint32(&c.lastTransactionId, 1)
 }
 
-func (c *Client) connectCommand() (err error) {
+// connectCommand issues the connect() command and waits for its
+// _result/_error the same way Call does, registering a pendingCommand
+// keyed on tid instead of special-casing the reply - that's what lets
+// a rejected connect surface the peer's actual error detail (and a
+// slow/missing reply time out) instead of collapsing to a bare bool.
+func (c *Client) connectCommand() error {
 	buf := new(bytes.Buffer)
 
 	amf.WriteString(buf, "connect")
 
 	tid := c.NextTransactionId()
+
+	p := &pendingCommand{name: "connect", ch: make(chan CommandResult, 1)}
+	c.pendingMu.Lock()
+	c.pendingCommands[tid] = p
+	c.pendingMu.Unlock()
+
 	amf.WriteDouble(buf, float64(tid))
 
 	opts := *amf.MakeObject()
@@ -162,14 +215,63 @@ func (c *Client) connectCommand() (err error) {
 
 	c.outMessages <- m
 
-	return
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCommandTimeout)
+	defer cancel()
+
+	select {
+	case result := <-p.ch:
+		c.connected = result.Err == nil
+		if result.Err != nil {
+			return result.Err
+		}
+
+		if len(result.Values) > 0 {
+			if info, ok := result.Values[len(result.Values)-1].(amf.Object); ok {
+				log.Debug("connect info: %+v", info)
+			}
+		}
+
+		return nil
+
+	case <-ctx.Done():
+		c.pendingMu.Lock()
+		delete(c.pendingCommands, tid)
+		c.pendingMu.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// onStatus is the default "onStatus" CommandHandler, bridging the
+// generic command dispatcher to the ClientHandler.OnStatus callback
+// every caller already implements.
+func (c *Client) onStatus(args []interface{}) {
+	if len(args) == 0 {
+		log.Warn("onStatus with no info object")
+		return
+	}
+
+	// The info object is the last argument, after the (null) command
+	// object.
+	obj, ok := args[len(args)-1].(amf.Object)
+	if !ok {
+		log.Warn("onStatus info was not an object: %+v", args[len(args)-1])
+		return
+	}
+
+	code, _ := obj["code"].(string)
+	log.Info("onStatus: %s", code)
+
+	if c.handler != nil {
+		c.handler.OnStatus(code, obj)
+	}
 }
 
 func (c *Client) Disconnect() {
 	c.connected = false
 	c.conn.Close()
 
-	log.Info("disconnected from %s", c.url, c.outBytes, c.inBytes)
+	log.Info("disconnected from %s", c.url, atomic.LoadUint32(&c.outBytes), atomic.LoadUint32(&c.inBytes))
 }
 
 func (c *Client) dispatchLoop() {
@@ -181,6 +283,19 @@ func (c *Client) dispatchLoop() {
 			c.handleProtocolMessage(m)
 		case CHUNK_STREAM_ID_COMMAND:
 			c.handleCommandMessage(m)
+		case CHUNK_STREAM_ID_USER_CONTROL:
+			c.handleUserControlMessage(m)
+		default:
+			switch m.Type {
+			case MESSAGE_TYPE_AUDIO, MESSAGE_TYPE_VIDEO:
+				c.handleMediaMessage(m)
+			case MESSAGE_TYPE_INVOKE, MESSAGE_TYPE_FLEX:
+				c.handleDataMessage(m)
+			default:
+				if c.handler != nil {
+					c.handler.OnReceive(m)
+				}
+			}
 		}
 	}
 }
@@ -192,12 +307,25 @@ func (c *Client) handleProtocolMessage(m *Message) {
 		log.Debug("setting chunk %d -> %d", c.inChunkSize, size)
 		c.inChunkSize = size
 
+	case MESSAGE_TYPE_ACK:
+		acked := binary.BigEndian.Uint32(m.Buffer.Bytes())
+		log.Debug("peer acked %d bytes", acked)
+		atomic.StoreUint32(&c.peerAckedBytes, acked)
+
+		select {
+		case c.sendResume <- struct{}{}:
+		default:
+		}
+
 	case MESSAGE_TYPE_ACK_SIZE:
-		log.Debug("ignoring ack size")
+		size := binary.BigEndian.Uint32(m.Buffer.Bytes())
+		log.Debug("setting inbound window size %d -> %d", atomic.LoadUint32(&c.inWindowSize), size)
+		atomic.StoreUint32(&c.inWindowSize, size)
 
 	case MESSAGE_TYPE_BANDWIDTH:
 		size := binary.BigEndian.Uint32(m.Buffer.Bytes())
-		log.Debug("ignoring bandwidth %d", size)
+		log.Debug("setting outbound window size %d -> %d", atomic.LoadUint32(&c.outWindowSize), size)
+		atomic.StoreUint32(&c.outWindowSize, size)
 
 	default:
 		log.Debug("ignoring other protocol message %d", m.Type)
@@ -205,63 +333,104 @@ func (c *Client) handleProtocolMessage(m *Message) {
 	}
 }
 
-func (c *Client) handleCommandMessage(m *Message) {
-	log.Debug("command message: %+v", m)
+// handleUserControlMessage processes User Control (type 4) events:
+// StreamBegin/StreamEOF are logged for visibility, and PingRequest is
+// answered immediately with a PingResponse carrying the same
+// timestamp, since peers that don't see one will eventually drop the
+// connection as unresponsive.
+func (c *Client) handleUserControlMessage(m *Message) {
+	data := m.Buffer.Bytes()
+	if len(data) < 2 {
+		log.Warn("truncated user control message")
+		return
+	}
 
-	c.connected = true
-}
+	event := binary.BigEndian.Uint16(data[0:2])
+	body := data[2:]
 
-func (c *Client) sendLoop() {
-	for {
-		m := <-c.outMessages
+	switch event {
+	case USER_CONTROL_STREAM_BEGIN:
+		if len(body) >= 4 {
+			log.Debug("stream begin: %d", binary.BigEndian.Uint32(body))
+		}
 
-		var cs *OutboundChunkStream = c.outChunkStreams[m.ChunkStreamId]
-		if cs == nil {
-			cs = NewOutboundChunkStream(m.ChunkStreamId)
+	case USER_CONTROL_STREAM_EOF:
+		if len(body) >= 4 {
+			log.Debug("stream eof: %d", binary.BigEndian.Uint32(body))
 		}
 
-		h := cs.NewOutboundHeader(m)
-
-		var n int64 = 0
-		var err error
-		var ws uint32 = 0
-		var rem uint32 = m.Length
-
-		for rem > 0 {
-			log.Debug("rem is %d", rem)
-			log.Debug("send message header: %+v", h)
-			_, err = h.Write(c)
-			if err != nil {
-				if c.connected {
-					log.Warn("unable to send header: %v", err)
-					c.Disconnect()
-				}
-				return
-			}
+	case USER_CONTROL_PING_REQUEST:
+		c.sendPingResponse(body)
 
-			ws = rem
-			if ws > c.outChunkSize {
-				ws = c.outChunkSize
-			}
+	default:
+		log.Debug("ignoring user control event %d", event)
+	}
+}
 
-			n, err = io.CopyN(c, m.Buffer, int64(ws))
-			if err != nil {
-				if c.connected {
-					log.Warn("unable to send message")
-					c.Disconnect()
-				}
-				return
-			}
+func (c *Client) sendPingResponse(timestamp []byte) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, USER_CONTROL_PING_RESPONSE)
+	buf.Write(timestamp)
 
-			rem -= uint32(n)
+	m := &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_USER_CONTROL,
+		Type:          MESSAGE_TYPE_PING,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
 
-			// Set the header to continuation only for the
-			// next iteration (if it happens).
-			h.Format = HEADER_FORMAT_CONTINUATION
-		}
+	c.outMessages <- m
+}
+
+// SetChunkSize updates the chunk size used for outbound messages and
+// notifies the peer via a protocol-level Set Chunk Size message so it
+// can decode subsequent chunks correctly.
+func (c *Client) SetChunkSize(size uint32) {
+	c.outChunkSize = size
 
-		log.Debug("finished sending message")
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, size)
 
+	m := &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_PROTOCOL,
+		Type:          MESSAGE_TYPE_CHUNK_SIZE,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
+
+	c.outMessages <- m
+}
+
+// sendAck emits an Acknowledgement (type 3) protocol message carrying
+// the total bytes received so far, as required once inBytes crosses
+// inWindowSize since the last one was sent.
+func (c *Client) sendAck() {
+	inBytes := atomic.LoadUint32(&c.inBytes)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, inBytes)
+
+	m := &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_PROTOCOL,
+		Type:          MESSAGE_TYPE_ACK,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
+
+	c.outMessages <- m
+	atomic.StoreUint32(&c.lastAckSent, inBytes)
+}
+
+// waitForSendWindow blocks sendLoop while the peer's advertised
+// bandwidth window would be exceeded, resuming as soon as an
+// Acknowledgement raises peerAckedBytes.
+func (c *Client) waitForSendWindow() {
+	for {
+		windowSize := atomic.LoadUint32(&c.outWindowSize)
+		if windowSize == 0 || atomic.LoadUint32(&c.outBytes)-atomic.LoadUint32(&c.peerAckedBytes) < windowSize {
+			return
+		}
+		<-c.sendResume
 	}
 }
 
@@ -372,14 +541,19 @@ func (c *Client) receiveLoop() {
 
 func (c *Client) Read(p []byte) (n int, err error) {
 	n, err = c.conn.Read(p)
-	c.inBytes += uint32(n)
+	inBytes := atomic.AddUint32(&c.inBytes, uint32(n))
 	log.Debug("read %d", n)
+
+	if windowSize := atomic.LoadUint32(&c.inWindowSize); windowSize > 0 && inBytes-atomic.LoadUint32(&c.lastAckSent) >= windowSize {
+		c.sendAck()
+	}
+
 	return n, err
 }
 
 func (c *Client) Write(p []byte) (n int, err error) {
 	n, err = c.conn.Write(p)
-	c.outBytes += uint32(n)
+	atomic.AddUint32(&c.outBytes, uint32(n))
 	log.Debug("write %d", n)
 	return n, err
-}
\ No newline at end of file
+}
@@ -0,0 +1,68 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestClientWaitForSendWindowNoLimit makes sure a zero outWindowSize,
+// which waitForSendWindow treats as no limit, never blocks the sender.
+func TestClientWaitForSendWindowNoLimit(t *testing.T) {
+	c := &Client{sendResume: make(chan struct{}, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		c.waitForSendWindow()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitForSendWindow blocked with outWindowSize == 0")
+	}
+}
+
+// TestClientWaitForSendWindowBlocksUntilAcked pins the flow-control
+// math: once outBytes - peerAckedBytes reaches outWindowSize, the
+// sender must block until an Acknowledgement raises peerAckedBytes
+// enough to open the window back up.
+func TestClientWaitForSendWindowBlocksUntilAcked(t *testing.T) {
+	c := &Client{
+		outWindowSize:  100,
+		outBytes:       100,
+		peerAckedBytes: 0,
+		sendResume:     make(chan struct{}, 1),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.waitForSendWindow()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("waitForSendWindow returned before the window reopened")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	atomic.StoreUint32(&c.peerAckedBytes, 0)
+	c.sendResume <- struct{}{}
+
+	select {
+	case <-done:
+		t.Fatal("waitForSendWindow returned while still at the window limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	atomic.StoreUint32(&c.peerAckedBytes, 1)
+	c.sendResume <- struct{}{}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitForSendWindow did not return after the window reopened")
+	}
+}
@@ -0,0 +1,234 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/elobuff/goamf"
+)
+
+// DefaultCommandTimeout bounds how long connect() and CreateStream wait
+// for a matching _result/_error. Call itself waits as long as its ctx
+// allows.
+const DefaultCommandTimeout = 10 * time.Second
+
+// CommandResult is what a pending Call is waiting on: the decoded
+// arguments that followed the command object in a _result, or an
+// error built from a _error reply.
+type CommandResult struct {
+	Values []interface{}
+	Err    error
+}
+
+type pendingCommand struct {
+	name string
+	ch   chan CommandResult
+}
+
+// CommandHandler receives the decoded arguments of a server-pushed
+// command (onStatus, onBWDone, onFCPublish, and any custom RPC a peer
+// invokes without a matching transaction id).
+type CommandHandler func(args []interface{})
+
+// Call invokes a remote command and waits for its _result/_error,
+// correlating the reply by transaction id. ctx bounds how long to
+// wait; CallTimeout is a convenience for the common fixed-duration
+// case.
+func (c *Client) Call(ctx context.Context, name string, args ...interface{}) ([]interface{}, error) {
+	tid := c.NextTransactionId()
+
+	p := &pendingCommand{name: name, ch: make(chan CommandResult, 1)}
+
+	c.pendingMu.Lock()
+	c.pendingCommands[tid] = p
+	c.pendingMu.Unlock()
+
+	buf := new(bytes.Buffer)
+	amf.WriteString(buf, name)
+	amf.WriteDouble(buf, float64(tid))
+	amf.WriteNull(buf)
+	for _, a := range args {
+		writeAMFValue(buf, a)
+	}
+
+	m := &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_COMMAND,
+		Type:          MESSAGE_TYPE_AMF0,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
+
+	c.outMessages <- m
+
+	select {
+	case result := <-p.ch:
+		return result.Values, result.Err
+
+	case <-ctx.Done():
+		c.pendingMu.Lock()
+		delete(c.pendingCommands, tid)
+		c.pendingMu.Unlock()
+
+		return nil, ctx.Err()
+	}
+}
+
+// CallTimeout is Call with a plain duration instead of a context.
+func (c *Client) CallTimeout(name string, timeout time.Duration, args ...interface{}) ([]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return c.Call(ctx, name, args...)
+}
+
+// HandleCommand registers handler to receive any incoming command
+// with the given method name that isn't claimed by a pending Call
+// (e.g. "onStatus", "onBWDone", "onFCPublish", or a custom server
+// push). Registering the same name again replaces the previous
+// handler.
+func (c *Client) HandleCommand(name string, handler CommandHandler) {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+
+	c.pushHandlers[name] = handler
+}
+
+func writeAMFValue(buf *bytes.Buffer, v interface{}) {
+	switch t := v.(type) {
+	case string:
+		amf.WriteString(buf, t)
+	case float64:
+		amf.WriteDouble(buf, t)
+	case int:
+		amf.WriteDouble(buf, float64(t))
+	case bool:
+		amf.WriteBoolean(buf, t)
+	case amf.Object:
+		amf.WriteObject(buf, t)
+	case nil:
+		amf.WriteNull(buf)
+	default:
+		log.Warn("unable to encode command argument of type %T", v)
+	}
+}
+
+// handleCommandMessage decodes an AMF0 or AMF3 command message
+// (connect/createStream/publish/play responses, onStatus, and any
+// other server push) and either delivers it to the Call awaiting that
+// transaction id, or to a registered CommandHandler by method name.
+func (c *Client) handleCommandMessage(m *Message) {
+	r := bytes.NewReader(m.Buffer.Bytes())
+	amf3 := m.Type == MESSAGE_TYPE_AMF3
+
+	if amf3 {
+		// AMF3 command messages carry a single leading encoding byte
+		// (always 0) ahead of the AMF3-encoded name/tid/arguments.
+		if _, err := r.ReadByte(); err != nil {
+			log.Warn("unable to read AMF3 command encoding byte: %v", err)
+			return
+		}
+	}
+
+	name, err := readAMFString(r, amf3)
+	if err != nil {
+		log.Warn("unable to read command name: %v", err)
+		return
+	}
+
+	tid, err := readAMFDouble(r, amf3)
+	if err != nil {
+		log.Warn("unable to read command transaction id: %v", err)
+		return
+	}
+
+	var values []interface{}
+	for {
+		v, err := readAMFValue(r, amf3)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Warn("unable to read command argument: %v", err)
+			break
+		}
+		values = append(values, v)
+	}
+
+	log.Debug("command message: %s (tid %v, %d args)", name, tid, len(values))
+
+	switch name {
+	case "_result", "_error":
+		id := uint32(tid)
+
+		c.pendingMu.Lock()
+		p, ok := c.pendingCommands[id]
+		if ok {
+			delete(c.pendingCommands, id)
+		}
+		c.pendingMu.Unlock()
+
+		if !ok {
+			return
+		}
+
+		result := CommandResult{Values: values}
+		if name == "_error" {
+			result.Err = fmt.Errorf("rtmp: %s failed: %+v", p.name, values)
+		}
+
+		select {
+		case p.ch <- result:
+		default:
+		}
+
+	default:
+		c.pushMu.Lock()
+		handler := c.pushHandlers[name]
+		c.pushMu.Unlock()
+
+		if handler != nil {
+			handler(values)
+		} else {
+			log.Debug("no handler registered for command %s", name)
+		}
+	}
+}
+
+func readAMFString(r *bytes.Reader, amf3 bool) (string, error) {
+	v, err := readAMFValue(r, amf3)
+	if err != nil {
+		return "", err
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("rtmp: expected string, got %T", v)
+	}
+
+	return s, nil
+}
+
+func readAMFDouble(r *bytes.Reader, amf3 bool) (float64, error) {
+	v, err := readAMFValue(r, amf3)
+	if err != nil {
+		return 0, err
+	}
+
+	d, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("rtmp: expected number, got %T", v)
+	}
+
+	return d, nil
+}
+
+func readAMFValue(r *bytes.Reader, amf3 bool) (interface{}, error) {
+	if amf3 {
+		return amf.AMF3_ReadValue(r)
+	}
+	return amf.ReadValue(r)
+}
@@ -0,0 +1,165 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// The helpers below hand-encode just enough of the AMF0 and AMF3 wire
+// formats to build known-good command messages, the same "pin a known
+// vector" approach handshake_test.go uses for the digest scheme.
+
+func amf0String(s string) []byte {
+	b := []byte{0x02} // AMF0 string marker
+	l := make([]byte, 2)
+	binary.BigEndian.PutUint16(l, uint16(len(s)))
+	b = append(b, l...)
+	return append(b, []byte(s)...)
+}
+
+func amf0Double(d float64) []byte {
+	b := []byte{0x00} // AMF0 number marker
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, math.Float64bits(d))
+	return append(b, v...)
+}
+
+func amf3U29(v uint32) []byte {
+	switch {
+	case v < 0x80:
+		return []byte{byte(v)}
+	case v < 0x4000:
+		return []byte{byte(v>>7) | 0x80, byte(v & 0x7F)}
+	default:
+		return []byte{byte(v>>14) | 0x80, byte((v>>7)&0x7F) | 0x80, byte(v & 0x7F)}
+	}
+}
+
+func amf3String(s string) []byte {
+	b := []byte{0x06} // AMF3 string marker
+	b = append(b, amf3U29(uint32(len(s))<<1|1)...)
+	return append(b, []byte(s)...)
+}
+
+func amf3Double(d float64) []byte {
+	b := []byte{0x05} // AMF3 double marker
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, math.Float64bits(d))
+	return append(b, v...)
+}
+
+// TestHandleCommandMessageAMF0Result pins AMF0 "_result" decoding: the
+// reply must be routed to the Call awaiting the encoded transaction
+// id, with its argument decoded.
+func TestHandleCommandMessageAMF0Result(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(amf0String("_result"))
+	buf.Write(amf0Double(3))
+	buf.Write(amf0Double(42))
+
+	ch := make(chan CommandResult, 1)
+	c := &Client{
+		pendingCommands: map[uint32]*pendingCommand{3: {name: "createStream", ch: ch}},
+		pushHandlers:    map[string]CommandHandler{},
+	}
+
+	c.handleCommandMessage(&Message{Type: MESSAGE_TYPE_AMF0, Buffer: &buf})
+
+	select {
+	case result := <-ch:
+		if result.Err != nil {
+			t.Fatalf("unexpected error: %v", result.Err)
+		}
+		if len(result.Values) != 1 || result.Values[0] != float64(42) {
+			t.Errorf("Values = %+v, want [42]", result.Values)
+		}
+	default:
+		t.Fatal("pending command was never delivered")
+	}
+
+	if _, ok := c.pendingCommands[3]; ok {
+		t.Error("pending command was not removed after delivery")
+	}
+}
+
+// TestHandleCommandMessageAMF3Result is the AMF3 mirror of the above:
+// the same tid-correlated routing must work through the AMF3 leading
+// encoding byte and AMF3-flavored name/tid/argument encoding.
+func TestHandleCommandMessageAMF3Result(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteByte(0x00) // AMF3 command messages lead with an encoding byte
+	buf.Write(amf3String("_result"))
+	buf.Write(amf3Double(7))
+	buf.Write(amf3String("ok"))
+
+	ch := make(chan CommandResult, 1)
+	c := &Client{
+		pendingCommands: map[uint32]*pendingCommand{7: {name: "publish", ch: ch}},
+		pushHandlers:    map[string]CommandHandler{},
+	}
+
+	c.handleCommandMessage(&Message{Type: MESSAGE_TYPE_AMF3, Buffer: &buf})
+
+	select {
+	case result := <-ch:
+		if result.Err != nil {
+			t.Fatalf("unexpected error: %v", result.Err)
+		}
+		if len(result.Values) != 1 || result.Values[0] != "ok" {
+			t.Errorf("Values = %+v, want [ok]", result.Values)
+		}
+	default:
+		t.Fatal("pending command was never delivered")
+	}
+}
+
+// TestHandleCommandMessageAMF0Error pins "_error" decoding: the Call
+// must come back with a non-nil error rather than being dropped.
+func TestHandleCommandMessageAMF0Error(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(amf0String("_error"))
+	buf.Write(amf0Double(1))
+
+	ch := make(chan CommandResult, 1)
+	c := &Client{
+		pendingCommands: map[uint32]*pendingCommand{1: {name: "connect", ch: ch}},
+		pushHandlers:    map[string]CommandHandler{},
+	}
+
+	c.handleCommandMessage(&Message{Type: MESSAGE_TYPE_AMF0, Buffer: &buf})
+
+	select {
+	case result := <-ch:
+		if result.Err == nil {
+			t.Error("expected a non-nil error for an _error reply")
+		}
+	default:
+		t.Fatal("pending command was never delivered")
+	}
+}
+
+// TestHandleCommandMessageUnmatchedNameUsesPushHandler makes sure a
+// command that isn't _result/_error and has no pending Call falls
+// through to a registered push handler (onStatus, onBWDone, ...).
+func TestHandleCommandMessageUnmatchedNameUsesPushHandler(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(amf0String("onStatus"))
+	buf.Write(amf0Double(0))
+	buf.Write(amf0Double(99))
+
+	var got []interface{}
+	c := &Client{
+		pendingCommands: map[uint32]*pendingCommand{},
+		pushHandlers: map[string]CommandHandler{
+			"onStatus": func(args []interface{}) { got = args },
+		},
+	}
+
+	c.handleCommandMessage(&Message{Type: MESSAGE_TYPE_AMF0, Buffer: &buf})
+
+	if len(got) != 1 || got[0] != float64(99) {
+		t.Errorf("push handler args = %+v, want [99]", got)
+	}
+}
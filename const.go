@@ -42,6 +42,16 @@ const (
 	MESSAGE_DISPATCH_QUEUE_LENGTH = 100
 )
 
+const (
+	USER_CONTROL_STREAM_BEGIN       = uint16(0x00)
+	USER_CONTROL_STREAM_EOF         = uint16(0x01)
+	USER_CONTROL_STREAM_DRY         = uint16(0x02)
+	USER_CONTROL_SET_BUFFER_LENGTH  = uint16(0x03)
+	USER_CONTROL_STREAM_IS_RECORDED = uint16(0x04)
+	USER_CONTROL_PING_REQUEST       = uint16(0x06)
+	USER_CONTROL_PING_RESPONSE      = uint16(0x07)
+)
+
 const (
 	DEFAULT_CHUNK_SIZE  = uint32(128)
 	DEFAULT_WINDOW_SIZE = uint32(2500000)
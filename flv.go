@@ -0,0 +1,226 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// FLV audio/video packet types, carried in the second byte of an
+// MESSAGE_TYPE_AUDIO/MESSAGE_TYPE_VIDEO payload right after the
+// codec/frame-type nibble, per the FLV tag spec.
+const (
+	FLV_AVC_SEQUENCE_HEADER = 0x00
+	FLV_AVC_NALU            = 0x01
+	FLV_AVC_END_OF_SEQUENCE = 0x02
+
+	FLV_AAC_SEQUENCE_HEADER = 0x00
+	FLV_AAC_RAW             = 0x01
+)
+
+// FLVTag is a single demuxed audio, video or metadata payload, shaped
+// like a tag body out of an FLV container with the RTMP chunk framing
+// already stripped away. ReadPacket/WritePacket exchange these so
+// callers never have to know about chunk streams or headers.
+type FLVTag struct {
+	Type      uint8
+	Timestamp uint32
+	StreamId  uint32
+	Data      []byte
+}
+
+// AVCDecoderConfigurationRecord holds the SPS/PPS pulled out of the
+// first H.264 sequence header video tag, as described in ISO/IEC
+// 14496-15 section 5.2.4.1. A muxer keeps one of these around per
+// publishing stream so it can be replayed to late-attaching
+// subscribers.
+type AVCDecoderConfigurationRecord struct {
+	ProfileIndication    uint8
+	ProfileCompatibility uint8
+	LevelIndication      uint8
+	NALUnitLength        uint8
+	SPS                  [][]byte
+	PPS                  [][]byte
+}
+
+// ParseAVCDecoderConfigurationRecord decodes the AVCC record embedded
+// in an AVC sequence header tag (the bytes following the 5-byte
+// video/packet-type/composition-time prefix).
+func ParseAVCDecoderConfigurationRecord(b []byte) (*AVCDecoderConfigurationRecord, error) {
+	if len(b) < 6 || b[0] != 1 {
+		return nil, errors.New("rtmp: invalid AVCDecoderConfigurationRecord")
+	}
+
+	r := &AVCDecoderConfigurationRecord{
+		ProfileIndication:    b[1],
+		ProfileCompatibility: b[2],
+		LevelIndication:      b[3],
+		NALUnitLength:        (b[4] & 0x03) + 1,
+	}
+
+	pos := 5
+	numSPS := int(b[pos] & 0x1F)
+	pos++
+
+	for i := 0; i < numSPS; i++ {
+		sps, next, err := readLengthPrefixed(b, pos)
+		if err != nil {
+			return nil, err
+		}
+		r.SPS = append(r.SPS, sps)
+		pos = next
+	}
+
+	if pos >= len(b) {
+		return nil, errors.New("rtmp: truncated AVCDecoderConfigurationRecord")
+	}
+	numPPS := int(b[pos])
+	pos++
+
+	for i := 0; i < numPPS; i++ {
+		pps, next, err := readLengthPrefixed(b, pos)
+		if err != nil {
+			return nil, err
+		}
+		r.PPS = append(r.PPS, pps)
+		pos = next
+	}
+
+	return r, nil
+}
+
+func readLengthPrefixed(b []byte, pos int) (data []byte, next int, err error) {
+	if pos+2 > len(b) {
+		return nil, 0, errors.New("rtmp: truncated AVCDecoderConfigurationRecord")
+	}
+
+	l := int(binary.BigEndian.Uint16(b[pos : pos+2]))
+	pos += 2
+
+	if pos+l > len(b) {
+		return nil, 0, errors.New("rtmp: truncated AVCDecoderConfigurationRecord")
+	}
+
+	return b[pos : pos+l], pos + l, nil
+}
+
+// AudioSpecificConfig holds the fields decoded from the ASC carried in
+// the first AAC sequence header audio tag, per ISO/IEC 14496-3.
+type AudioSpecificConfig struct {
+	ObjectType      uint8
+	SampleRateIndex uint8
+	ChannelConfig   uint8
+}
+
+// ParseAudioSpecificConfig decodes the ASC embedded in an AAC sequence
+// header tag (the bytes following the 2-byte sound-format/packet-type
+// prefix).
+func ParseAudioSpecificConfig(b []byte) (*AudioSpecificConfig, error) {
+	if len(b) < 2 {
+		return nil, errors.New("rtmp: invalid AudioSpecificConfig")
+	}
+
+	return &AudioSpecificConfig{
+		ObjectType:      (b[0] >> 3) & 0x1F,
+		SampleRateIndex: ((b[0] & 0x07) << 1) | (b[1] >> 7),
+		ChannelConfig:   (b[1] >> 3) & 0x0F,
+	}, nil
+}
+
+// handleMediaMessage demuxes an incoming audio/video message into an
+// FLVTag, capturing the AVC/AAC sequence headers the first time each
+// is seen so later callers (or a re-publishing subscriber) can recover
+// them without re-requesting from the publisher.
+func (c *Client) handleMediaMessage(m *Message) {
+	data := m.Buffer.Bytes()
+
+	switch m.Type {
+	case MESSAGE_TYPE_VIDEO:
+		if len(data) >= 6 && data[0]&0x0F == 7 && data[1] == FLV_AVC_SEQUENCE_HEADER {
+			cfg, err := ParseAVCDecoderConfigurationRecord(data[5:])
+			if err != nil {
+				log.Warn("unable to parse AVC sequence header: %v", err)
+				break
+			}
+			c.videoConfig = cfg
+			log.Debug("captured AVC sequence header: %d sps, %d pps", len(cfg.SPS), len(cfg.PPS))
+		}
+
+	case MESSAGE_TYPE_AUDIO:
+		if len(data) >= 4 && data[0]>>4 == 10 && data[1] == FLV_AAC_SEQUENCE_HEADER {
+			cfg, err := ParseAudioSpecificConfig(data[2:])
+			if err != nil {
+				log.Warn("unable to parse AudioSpecificConfig: %v", err)
+				break
+			}
+			c.audioConfig = cfg
+			log.Debug("captured AudioSpecificConfig: object type %d", cfg.ObjectType)
+		}
+	}
+
+	c.flvTags <- &FLVTag{
+		Type:      m.Type,
+		Timestamp: m.AbsoluteTimestamp,
+		StreamId:  m.StreamId,
+		Data:      data,
+	}
+}
+
+// handleDataMessage demuxes an incoming AMF0/AMF3 data message (most
+// notably onMetaData, which OBS/ffmpeg and every other real publisher
+// send ahead of the first media frame) into an FLVTag alongside audio
+// and video, since ReadPacket is the one channel a caller drains for
+// everything a played stream carries.
+func (c *Client) handleDataMessage(m *Message) {
+	c.flvTags <- &FLVTag{
+		Type:      m.Type,
+		Timestamp: m.AbsoluteTimestamp,
+		StreamId:  m.StreamId,
+		Data:      m.Buffer.Bytes(),
+	}
+}
+
+// VideoConfig returns the AVC sequence header captured from the
+// stream, or nil if none has arrived yet.
+func (c *Client) VideoConfig() *AVCDecoderConfigurationRecord {
+	return c.videoConfig
+}
+
+// AudioConfig returns the AAC ASC captured from the stream, or nil if
+// none has arrived yet.
+func (c *Client) AudioConfig() *AudioSpecificConfig {
+	return c.audioConfig
+}
+
+// ReadPacket blocks until the next demuxed audio, video or metadata
+// tag is available on a played stream.
+func (c *Client) ReadPacket() (*FLVTag, error) {
+	tag, ok := <-c.flvTags
+	if !ok {
+		return nil, errors.New("rtmp: connection closed")
+	}
+
+	return tag, nil
+}
+
+// WritePacket re-wraps an FLV-style tag into an RTMP message on the
+// given stream and queues it for sending, the mirror of ReadPacket for
+// publishing.
+func (c *Client) WritePacket(s *NetStream, tag *FLVTag) error {
+	if !c.connected {
+		return errors.New("rtmp: not connected")
+	}
+
+	m := &Message{
+		ChunkStreamId: s.chunkStreamId,
+		Type:          tag.Type,
+		StreamId:      s.id,
+		Timestamp:     tag.Timestamp,
+		Length:        uint32(len(tag.Data)),
+		Buffer:        bytes.NewBuffer(tag.Data),
+	}
+
+	c.outMessages <- m
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestParseAVCDecoderConfigurationRecord pins the AVCC layout this
+// decodes against a known-good record: one SPS, one PPS, a 4-byte
+// NAL unit length.
+func TestParseAVCDecoderConfigurationRecord(t *testing.T) {
+	record := []byte{
+		0x01,       // configurationVersion
+		0x64,       // AVCProfileIndication
+		0x00,       // profile_compatibility
+		0x1F,       // AVCLevelIndication
+		0xFF,       // reserved | lengthSizeMinusOne (3 -> 4 bytes)
+		0xE1,       // reserved | numOfSequenceParameterSets (1)
+		0x00, 0x03, // SPS length
+		0xAA, 0xBB, 0xCC, // SPS
+		0x01,       // numOfPictureParameterSets
+		0x00, 0x02, // PPS length
+		0xDD, 0xEE, // PPS
+	}
+
+	cfg, err := ParseAVCDecoderConfigurationRecord(record)
+	if err != nil {
+		t.Fatalf("ParseAVCDecoderConfigurationRecord failed: %v", err)
+	}
+
+	if cfg.ProfileIndication != 0x64 || cfg.ProfileCompatibility != 0x00 || cfg.LevelIndication != 0x1F {
+		t.Errorf("profile fields = %+v, want {0x64 0x00 0x1F}", cfg)
+	}
+	if cfg.NALUnitLength != 4 {
+		t.Errorf("NALUnitLength = %d, want 4", cfg.NALUnitLength)
+	}
+	if len(cfg.SPS) != 1 || !bytes.Equal(cfg.SPS[0], []byte{0xAA, 0xBB, 0xCC}) {
+		t.Errorf("SPS = %x, want [[aabbcc]]", cfg.SPS)
+	}
+	if len(cfg.PPS) != 1 || !bytes.Equal(cfg.PPS[0], []byte{0xDD, 0xEE}) {
+		t.Errorf("PPS = %x, want [[ddee]]", cfg.PPS)
+	}
+}
+
+// TestParseAVCDecoderConfigurationRecordTruncated makes sure a record
+// cut off mid-SPS is rejected rather than panicking on a short slice.
+func TestParseAVCDecoderConfigurationRecordTruncated(t *testing.T) {
+	record := []byte{0x01, 0x64, 0x00, 0x1F, 0xFF, 0xE1, 0x00, 0x03, 0xAA}
+
+	if _, err := ParseAVCDecoderConfigurationRecord(record); err == nil {
+		t.Error("expected an error for a truncated record, got nil")
+	}
+}
+
+// TestParseAVCDecoderConfigurationRecordBadVersion rejects a record
+// whose configurationVersion isn't 1, the sentinel this decoder uses
+// to recognize the AVCC layout at all.
+func TestParseAVCDecoderConfigurationRecordBadVersion(t *testing.T) {
+	record := []byte{0x02, 0x64, 0x00, 0x1F, 0xFF, 0xE0}
+
+	if _, err := ParseAVCDecoderConfigurationRecord(record); err == nil {
+		t.Error("expected an error for a non-1 configurationVersion, got nil")
+	}
+}
+
+// TestParseAudioSpecificConfig pins the ASC bit layout against an AAC
+// LC / 44100Hz / stereo configuration.
+func TestParseAudioSpecificConfig(t *testing.T) {
+	asc := []byte{0x12, 0x10}
+
+	cfg, err := ParseAudioSpecificConfig(asc)
+	if err != nil {
+		t.Fatalf("ParseAudioSpecificConfig failed: %v", err)
+	}
+
+	if cfg.ObjectType != 2 {
+		t.Errorf("ObjectType = %d, want 2 (AAC LC)", cfg.ObjectType)
+	}
+	if cfg.SampleRateIndex != 4 {
+		t.Errorf("SampleRateIndex = %d, want 4 (44100Hz)", cfg.SampleRateIndex)
+	}
+	if cfg.ChannelConfig != 2 {
+		t.Errorf("ChannelConfig = %d, want 2 (stereo)", cfg.ChannelConfig)
+	}
+}
+
+// TestParseAudioSpecificConfigTooShort rejects a config shorter than
+// the 2 bytes every field above is packed into.
+func TestParseAudioSpecificConfigTooShort(t *testing.T) {
+	if _, err := ParseAudioSpecificConfig([]byte{0x12}); err == nil {
+		t.Error("expected an error for a 1-byte config, got nil")
+	}
+}
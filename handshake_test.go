@@ -0,0 +1,87 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+// TestDigestOffsetKnownVectors pins digestOffset's arithmetic against
+// fixed inputs, since a one-off change to the sum/modulo would shift
+// every offset it computes without any other test noticing.
+func TestDigestOffsetKnownVectors(t *testing.T) {
+	buf := make([]byte, handshakeSize)
+
+	buf[8], buf[9], buf[10], buf[11] = 1, 2, 3, 4
+	if got, want := digestOffset(buf, 0), 10%728+12; got != want {
+		t.Errorf("scheme 0 offset = %d, want %d", got, want)
+	}
+
+	buf[772], buf[773], buf[774], buf[775] = 10, 20, 30, 40
+	if got, want := digestOffset(buf, 1), 100%728+776; got != want {
+		t.Errorf("scheme 1 offset = %d, want %d", got, want)
+	}
+}
+
+// TestSignAndVerifyDigestRoundTrip pairs signDigest against
+// verifyDigest with a fixed key, the same pairing a real FMS/nginx-rtmp
+// peer performs on S1.
+func TestSignAndVerifyDigestRoundTrip(t *testing.T) {
+	key := genuineFMSKey[:36]
+
+	s1 := make([]byte, handshakeSize)
+	if _, err := rand.Read(s1); err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(s1[4:8], handshakeVersion)
+
+	offset := digestOffset(s1, 0)
+	signDigest(s1, offset, key)
+
+	digest, err := verifyDigest(s1, key)
+	if err != nil {
+		t.Fatalf("verifyDigest failed on a digest signDigest just wrote: %v", err)
+	}
+	if !bytes.Equal(digest, s1[offset:offset+32]) {
+		t.Errorf("verifyDigest returned %x, want %x", digest, s1[offset:offset+32])
+	}
+}
+
+// TestVerifyDigestRejectsWrongKey makes sure a digest signed with one
+// key doesn't validate against another, the case that matters for
+// rejecting a peer that isn't genuine FMS.
+func TestVerifyDigestRejectsWrongKey(t *testing.T) {
+	s1 := make([]byte, handshakeSize)
+	if _, err := rand.Read(s1); err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(s1[4:8], handshakeVersion)
+
+	offset := digestOffset(s1, 0)
+	signDigest(s1, offset, genuineFPKey[:30])
+
+	if _, err := verifyDigest(s1, genuineFMSKey[:36]); err != errHandshakeDigestNotFound {
+		t.Errorf("verifyDigest against the wrong key = %v, want errHandshakeDigestNotFound", err)
+	}
+}
+
+// TestHmacSHA256KnownVector pins hmacSHA256 against RFC 4231 test case
+// 1, the HMAC-SHA256 vector every digest/signature call in this file
+// ultimately reduces to.
+func TestHmacSHA256KnownVector(t *testing.T) {
+	key := bytes.Repeat([]byte{0x0b}, 20)
+	data := []byte("Hi There")
+
+	want := []byte{
+		0xb0, 0x34, 0x4c, 0x61, 0xd8, 0xdb, 0x38, 0x53,
+		0x5c, 0xa8, 0xaf, 0xce, 0xaf, 0x0b, 0xf1, 0x2b,
+		0x88, 0x1d, 0xc2, 0x00, 0xc9, 0x83, 0x3d, 0xa7,
+		0x26, 0xe9, 0x37, 0x6c, 0x2e, 0x32, 0xcf, 0xf7,
+	}
+
+	got := hmacSHA256(key, data)
+	if !bytes.Equal(got, want) {
+		t.Errorf("hmacSHA256 = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,330 @@
+package rtmp
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// videoQueueDepth bounds how many whole video messages can sit queued
+// on a single chunk stream before the oldest is dropped in favor of
+// the newest. Audio and control messages are never dropped - losing
+// those is far more noticeable than a skipped or stale video frame.
+const videoQueueDepth = 8
+
+// outboundPriority orders which chunk streams get to send a chunk
+// first on contention, so a large video keyframe can never head-of-
+// line block a control message or an audio packet behind it.
+type outboundPriority int
+
+const (
+	priorityControl outboundPriority = iota
+	priorityAudio
+	priorityVideo
+	priorityOther
+)
+
+func messagePriority(m *Message) outboundPriority {
+	switch m.ChunkStreamId {
+	case CHUNK_STREAM_ID_PROTOCOL, CHUNK_STREAM_ID_COMMAND, CHUNK_STREAM_ID_USER_CONTROL:
+		return priorityControl
+	}
+
+	switch m.Type {
+	case MESSAGE_TYPE_AUDIO:
+		return priorityAudio
+	case MESSAGE_TYPE_VIDEO:
+		return priorityVideo
+	default:
+		return priorityOther
+	}
+}
+
+// outboundQueue holds one chunk stream's pending whole messages plus
+// whatever message it's partway through chunking out, so the
+// scheduler can interleave a single chunk from this stream with a
+// single chunk from every other active stream instead of draining one
+// message fully before moving on.
+type outboundQueue struct {
+	mu       sync.Mutex
+	priority outboundPriority
+	pending  []*Message
+
+	message   *Message
+	header    *Header
+	remaining uint32
+}
+
+// outboundSender is the minimal surface Client and ServerConn each
+// expose so the priority scheduler below can live in one place instead
+// of being hand-duplicated (once per type, Client/ServerConn renamed)
+// as it used to be.
+type outboundSender interface {
+	io.Writer
+
+	outboundMessages() <-chan *Message
+	outQueueFor(m *Message) *outboundQueue
+	outQueueSnapshot() []*outboundQueue
+	wakeSender()
+	sendSignalChan() chan struct{}
+	waitForSendWindow()
+	chunkSize() uint32
+	outboundChunkStream(chunkStreamId uint32) *OutboundChunkStream
+	reportSendError(context string, err error)
+}
+
+// dispatchOutbound classifies and enqueues every message a caller
+// (connect/command/publish/WritePacket/sendStatus/relayMedia/...)
+// sends on outMessages, waking the scheduler in sendLoop.
+func dispatchOutbound(s outboundSender) {
+	for m := range s.outboundMessages() {
+		enqueueOutbound(s, m)
+	}
+}
+
+func enqueueOutbound(s outboundSender, m *Message) {
+	q := s.outQueueFor(m)
+
+	q.mu.Lock()
+	if q.priority == priorityVideo && len(q.pending) >= videoQueueDepth {
+		log.Warn("dropping stale video frame on chunk stream %d, queue full", m.ChunkStreamId)
+		q.pending = q.pending[1:]
+	}
+	q.pending = append(q.pending, m)
+	q.mu.Unlock()
+
+	s.wakeSender()
+}
+
+// sendLoop is the outbound scheduler: it repeatedly sweeps every
+// active chunk stream in priority order, writing one chunk from each,
+// and sleeps only once a full sweep sends nothing at all.
+func sendLoop(s outboundSender) {
+	for {
+		if !sendOneRound(s) {
+			<-s.sendSignalChan()
+		}
+	}
+}
+
+func sendOneRound(s outboundSender) bool {
+	queues := s.outQueueSnapshot()
+
+	sort.Slice(queues, func(i, j int) bool { return queues[i].priority < queues[j].priority })
+
+	sentAny := false
+	for _, q := range queues {
+		if sendOneChunk(s, q) {
+			sentAny = true
+		}
+	}
+
+	return sentAny
+}
+
+// sendOneChunk writes at most one outChunkSize-sized chunk for q,
+// starting its next pending message if it isn't already partway
+// through one. It reports whether it did any work, so the caller can
+// tell an idle stream from one that just finished.
+func sendOneChunk(s outboundSender, q *outboundQueue) bool {
+	q.mu.Lock()
+	if q.message == nil {
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return false
+		}
+
+		m := q.pending[0]
+		q.pending = q.pending[1:]
+
+		cs := s.outboundChunkStream(m.ChunkStreamId)
+
+		q.message = m
+		q.header = cs.NewOutboundHeader(m)
+		q.remaining = m.Length
+	}
+
+	m := q.message
+	h := q.header
+	rem := q.remaining
+	q.mu.Unlock()
+
+	s.waitForSendWindow()
+
+	if _, err := h.Write(s); err != nil {
+		s.reportSendError("unable to send header", err)
+		return false
+	}
+
+	ws := rem
+	if cs := s.chunkSize(); ws > cs {
+		ws = cs
+	}
+
+	n, err := io.CopyN(s, m.Buffer, int64(ws))
+	if err != nil {
+		s.reportSendError("unable to send message", err)
+		return false
+	}
+
+	q.mu.Lock()
+	q.remaining -= uint32(n)
+	if q.remaining == 0 {
+		q.message = nil
+		q.header = nil
+	} else {
+		q.header.Format = HEADER_FORMAT_CONTINUATION
+	}
+	q.mu.Unlock()
+
+	return true
+}
+
+// dispatchOutbound classifies and enqueues every message a caller
+// (connect/command/publish/WritePacket/...) sends on outMessages,
+// waking the scheduler in sendLoop.
+func (c *Client) dispatchOutbound() { dispatchOutbound(c) }
+
+// sendLoop repeatedly sweeps every active chunk stream in priority
+// order, writing one chunk from each, and sleeps only once a full
+// sweep sends nothing at all.
+func (c *Client) sendLoop() { sendLoop(c) }
+
+func (c *Client) outboundMessages() <-chan *Message { return c.outMessages }
+
+func (c *Client) outQueueFor(m *Message) *outboundQueue {
+	c.outQueuesMu.Lock()
+	defer c.outQueuesMu.Unlock()
+
+	q, ok := c.outQueues[m.ChunkStreamId]
+	if !ok {
+		q = &outboundQueue{priority: messagePriority(m)}
+		c.outQueues[m.ChunkStreamId] = q
+	}
+
+	return q
+}
+
+func (c *Client) outQueueSnapshot() []*outboundQueue {
+	c.outQueuesMu.Lock()
+	defer c.outQueuesMu.Unlock()
+
+	queues := make([]*outboundQueue, 0, len(c.outQueues))
+	for _, q := range c.outQueues {
+		queues = append(queues, q)
+	}
+
+	return queues
+}
+
+func (c *Client) wakeSender() {
+	select {
+	case c.sendSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) sendSignalChan() chan struct{} { return c.sendSignal }
+
+func (c *Client) chunkSize() uint32 { return c.outChunkSize }
+
+// reportSendError logs and tears down the connection on a send
+// failure, but only while connected - a failure after an already
+// in-progress Disconnect is expected, not worth another log line.
+func (c *Client) reportSendError(context string, err error) {
+	if c.connected {
+		log.Warn("%s: %v", context, err)
+		c.Disconnect()
+	}
+}
+
+// outboundChunkStream looks up (or lazily creates) the
+// OutboundChunkStream for id, guarding the map with
+// outChunkStreamsMu.
+func (c *Client) outboundChunkStream(id uint32) *OutboundChunkStream {
+	c.outChunkStreamsMu.Lock()
+	defer c.outChunkStreamsMu.Unlock()
+
+	cs := c.outChunkStreams[id]
+	if cs == nil {
+		cs = NewOutboundChunkStream(id)
+		c.outChunkStreams[id] = cs
+	}
+
+	return cs
+}
+
+// dispatchOutbound is ServerConn's mirror of Client.dispatchOutbound:
+// it classifies and enqueues every message a caller (sendCommand/
+// sendStatus/relayMedia/...) sends on outMessages, waking the
+// scheduler in sendLoop. Server is the many-subscriber fan-out point
+// the scheduler matters most for - a single slow viewer must never
+// head-of-line block the rest of a broadcast.
+func (sc *ServerConn) dispatchOutbound() { dispatchOutbound(sc) }
+
+// sendLoop is ServerConn's mirror of Client.sendLoop: it repeatedly
+// sweeps every active chunk stream in priority order, writing one
+// chunk from each, and sleeps only once a full sweep sends nothing.
+func (sc *ServerConn) sendLoop() { sendLoop(sc) }
+
+func (sc *ServerConn) outboundMessages() <-chan *Message { return sc.outMessages }
+
+func (sc *ServerConn) outQueueFor(m *Message) *outboundQueue {
+	sc.outQueuesMu.Lock()
+	defer sc.outQueuesMu.Unlock()
+
+	q, ok := sc.outQueues[m.ChunkStreamId]
+	if !ok {
+		q = &outboundQueue{priority: messagePriority(m)}
+		sc.outQueues[m.ChunkStreamId] = q
+	}
+
+	return q
+}
+
+func (sc *ServerConn) outQueueSnapshot() []*outboundQueue {
+	sc.outQueuesMu.Lock()
+	defer sc.outQueuesMu.Unlock()
+
+	queues := make([]*outboundQueue, 0, len(sc.outQueues))
+	for _, q := range sc.outQueues {
+		queues = append(queues, q)
+	}
+
+	return queues
+}
+
+func (sc *ServerConn) wakeSender() {
+	select {
+	case sc.sendSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (sc *ServerConn) sendSignalChan() chan struct{} { return sc.sendSignal }
+
+func (sc *ServerConn) chunkSize() uint32 { return sc.outChunkSize }
+
+// reportSendError tears down the connection on a send failure. Unlike
+// Client, a ServerConn has no pre-connect()-but-already-disconnected
+// window to special-case here: Disconnect is idempotent (see
+// closeOnce), so this can fire unconditionally.
+func (sc *ServerConn) reportSendError(context string, err error) {
+	sc.Disconnect()
+}
+
+// outboundChunkStream looks up (or lazily creates) the
+// OutboundChunkStream for id, guarding the map with
+// outChunkStreamsMu.
+func (sc *ServerConn) outboundChunkStream(id uint32) *OutboundChunkStream {
+	sc.outChunkStreamsMu.Lock()
+	defer sc.outChunkStreamsMu.Unlock()
+
+	cs := sc.outChunkStreams[id]
+	if cs == nil {
+		cs = NewOutboundChunkStream(id)
+		sc.outChunkStreams[id] = cs
+	}
+
+	return cs
+}
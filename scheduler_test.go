@@ -0,0 +1,102 @@
+package rtmp
+
+import "testing"
+
+func TestMessagePriority(t *testing.T) {
+	cases := []struct {
+		name string
+		m    *Message
+		want outboundPriority
+	}{
+		{
+			name: "protocol chunk stream wins regardless of type",
+			m:    &Message{ChunkStreamId: CHUNK_STREAM_ID_PROTOCOL, Type: MESSAGE_TYPE_VIDEO},
+			want: priorityControl,
+		},
+		{
+			name: "command chunk stream wins regardless of type",
+			m:    &Message{ChunkStreamId: CHUNK_STREAM_ID_COMMAND, Type: MESSAGE_TYPE_AUDIO},
+			want: priorityControl,
+		},
+		{
+			name: "user control chunk stream wins regardless of type",
+			m:    &Message{ChunkStreamId: CHUNK_STREAM_ID_USER_CONTROL, Type: MESSAGE_TYPE_AMF0},
+			want: priorityControl,
+		},
+		{
+			name: "audio on a data chunk stream",
+			m:    &Message{ChunkStreamId: 5, Type: MESSAGE_TYPE_AUDIO},
+			want: priorityAudio,
+		},
+		{
+			name: "video on a data chunk stream",
+			m:    &Message{ChunkStreamId: 5, Type: MESSAGE_TYPE_VIDEO},
+			want: priorityVideo,
+		},
+		{
+			name: "anything else falls back to other",
+			m:    &Message{ChunkStreamId: 5, Type: MESSAGE_TYPE_AMF0},
+			want: priorityOther,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := messagePriority(c.m); got != c.want {
+				t.Errorf("messagePriority(%+v) = %d, want %d", c.m, got, c.want)
+			}
+		})
+	}
+}
+
+// TestEnqueueOutboundDropsOldestVideoWhenFull pins the bounded-depth
+// behavior on a video chunk stream: once videoQueueDepth messages are
+// pending, enqueuing another drops the oldest rather than growing the
+// queue or blocking the dispatcher.
+func TestEnqueueOutboundDropsOldestVideoWhenFull(t *testing.T) {
+	c := &Client{
+		outQueues:  make(map[uint32]*outboundQueue),
+		sendSignal: make(chan struct{}, 1),
+	}
+
+	const chunkStreamId = 5
+	const sent = videoQueueDepth + 2
+
+	for i := 1; i <= sent; i++ {
+		enqueueOutbound(c, &Message{ChunkStreamId: chunkStreamId, Type: MESSAGE_TYPE_VIDEO, StreamId: uint32(i)})
+	}
+
+	q := c.outQueues[chunkStreamId]
+	if len(q.pending) != videoQueueDepth {
+		t.Fatalf("pending = %d, want %d", len(q.pending), videoQueueDepth)
+	}
+
+	wantFirst := uint32(sent - videoQueueDepth + 1)
+	if got := q.pending[0].StreamId; got != wantFirst {
+		t.Errorf("oldest surviving message StreamId = %d, want %d (earlier ones should have been dropped)", got, wantFirst)
+	}
+	if got := q.pending[len(q.pending)-1].StreamId; got != uint32(sent) {
+		t.Errorf("newest message StreamId = %d, want %d", got, sent)
+	}
+}
+
+// TestEnqueueOutboundNeverDropsAudio mirrors the video-drop test but
+// on audio, which has no queue depth cap: every message must survive.
+func TestEnqueueOutboundNeverDropsAudio(t *testing.T) {
+	c := &Client{
+		outQueues:  make(map[uint32]*outboundQueue),
+		sendSignal: make(chan struct{}, 1),
+	}
+
+	const chunkStreamId = 6
+	const sent = videoQueueDepth + 2
+
+	for i := 1; i <= sent; i++ {
+		enqueueOutbound(c, &Message{ChunkStreamId: chunkStreamId, Type: MESSAGE_TYPE_AUDIO, StreamId: uint32(i)})
+	}
+
+	q := c.outQueues[chunkStreamId]
+	if len(q.pending) != sent {
+		t.Fatalf("pending = %d, want %d (audio must never be dropped)", len(q.pending), sent)
+	}
+}
@@ -0,0 +1,815 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elobuff/goamf"
+)
+
+// ConnectHandler decides whether an incoming connect() to app should
+// be accepted. Returning false rejects the connection.
+type ConnectHandler func(conn *ServerConn, app string) bool
+
+// PublishHandler decides whether an incoming publish() of name should
+// be accepted.
+type PublishHandler func(conn *ServerConn, name string) bool
+
+// PlayHandler decides whether an incoming play() of name should be
+// accepted.
+type PlayHandler func(conn *ServerConn, name string) bool
+
+// AppHandlers are the callbacks a caller registers for a given app
+// (the "app" property of the command object passed to connect(); the
+// tcUrl is not consulted), mirroring how
+// joy4 and mediamtx let callers hang logic off of an RTMP app name.
+type AppHandlers struct {
+	OnConnect ConnectHandler
+	OnPublish PublishHandler
+	OnPlay    PlayHandler
+}
+
+// Server accepts RTMP connections and dispatches connect/publish/play
+// requests to per-app handlers. It is the server-side mirror of
+// Client: where Client drives one outbound connection, Server fans
+// inbound connections out across ServerConns.
+type Server struct {
+	addr      string
+	tlsConfig *tls.Config
+	listener  net.Listener
+
+	mu   sync.Mutex
+	apps map[string]AppHandlers
+
+	streamsMu sync.Mutex
+	streams   map[string]*serverStream
+}
+
+// NewServer creates a plain-TCP RTMP server listening on addr (e.g.
+// ":1935").
+func NewServer(addr string) *Server {
+	return &Server{
+		addr:    addr,
+		apps:    make(map[string]AppHandlers),
+		streams: make(map[string]*serverStream),
+	}
+}
+
+// NewTLSServer creates an RTMPS server listening on addr using config.
+func NewTLSServer(addr string, config *tls.Config) *Server {
+	s := NewServer(addr)
+	s.tlsConfig = config
+	return s
+}
+
+// Handle registers the connect/publish/play handlers for app. Connections
+// whose connect() "app" property names an unregistered app are rejected.
+func (s *Server) Handle(app string, h AppHandlers) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apps[app] = h
+}
+
+func (s *Server) handlersFor(app string) (AppHandlers, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.apps[app]
+	return h, ok
+}
+
+// ListenAndServe binds the listener and serves connections until the
+// listener is closed or Accept fails.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	return s.serve(listener)
+}
+
+// ListenAndServeTLS is ListenAndServe over a TLS listener, using the
+// config passed to NewTLSServer.
+func (s *Server) ListenAndServeTLS() error {
+	listener, err := tls.Listen("tcp", s.addr, s.tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	return s.serve(listener)
+}
+
+func (s *Server) serve(listener net.Listener) error {
+	s.listener = listener
+
+	log.Info("listening for rtmp connections on %s", s.addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.accept(conn)
+	}
+}
+
+// Close stops accepting new connections.
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *Server) accept(conn net.Conn) {
+	sc := newServerConn(conn, s)
+
+	if err := sc.handshake(); err != nil {
+		log.Warn("handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	log.Info("accepted connection from %s", conn.RemoteAddr())
+
+	go sc.dispatchLoop()
+	go sc.dispatchOutbound()
+	go sc.sendLoop()
+	sc.receiveLoop()
+}
+
+// serverStream is the server-side registry entry for a single
+// published name: the publisher connection, its current subscribers,
+// and the last sequence headers seen so a subscriber that attaches
+// mid-stream can still decode what follows.
+type serverStream struct {
+	name string
+
+	mu          sync.Mutex
+	publisher   *ServerConn
+	subscribers map[*ServerConn]uint32 // conn -> that conn's NetStream id
+
+	videoSeqHeader []byte
+	audioSeqHeader []byte
+}
+
+func (s *Server) stream(name string) *serverStream {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+
+	st, ok := s.streams[name]
+	if !ok {
+		st = &serverStream{name: name, subscribers: make(map[*ServerConn]uint32)}
+		s.streams[name] = st
+	}
+
+	return st
+}
+
+func (st *serverStream) addSubscriber(conn *ServerConn, streamId uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.subscribers[conn] = streamId
+
+	if st.videoSeqHeader != nil {
+		conn.relayMedia(streamId, MESSAGE_TYPE_VIDEO, st.videoSeqHeader)
+	}
+	if st.audioSeqHeader != nil {
+		conn.relayMedia(streamId, MESSAGE_TYPE_AUDIO, st.audioSeqHeader)
+	}
+}
+
+func (st *serverStream) removeSubscriber(conn *ServerConn) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	delete(st.subscribers, conn)
+}
+
+// removePublisher clears conn as this stream's publisher, but only if
+// it's still the current one - a reconnecting publisher may already
+// have replaced it by the time the old conn's Disconnect runs.
+func (st *serverStream) removePublisher(conn *ServerConn) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.publisher == conn {
+		st.publisher = nil
+	}
+}
+
+// relay fans a just-published media message out to every subscriber,
+// caching it first if it's a sequence header so late subscribers can
+// be brought up to date in addSubscriber.
+func (st *serverStream) relay(m *Message) {
+	data := m.Buffer.Bytes()
+
+	st.mu.Lock()
+	if m.Type == MESSAGE_TYPE_VIDEO && len(data) >= 2 && data[0]&0x0F == 7 && data[1] == FLV_AVC_SEQUENCE_HEADER {
+		st.videoSeqHeader = append([]byte(nil), data...)
+	}
+	if m.Type == MESSAGE_TYPE_AUDIO && len(data) >= 2 && data[0]>>4 == 10 && data[1] == FLV_AAC_SEQUENCE_HEADER {
+		st.audioSeqHeader = append([]byte(nil), data...)
+	}
+
+	for conn, streamId := range st.subscribers {
+		conn.relayMedia(streamId, m.Type, data)
+	}
+	st.mu.Unlock()
+}
+
+// ServerConn is a single accepted RTMP connection: the server-side
+// mirror of Client, driving the same chunk stream / message plumbing
+// but responding to peer-initiated commands instead of issuing them.
+type ServerConn struct {
+	server *Server
+	conn   net.Conn
+
+	// connected reflects application-level state: whether this conn's
+	// connect() has been accepted. closeOnce guards the socket's
+	// lifetime instead - a peer can disconnect (or send garbage that
+	// fails a header read) before ever completing connect(), and
+	// Disconnect must still close the fd and stop the loops in that
+	// case, not just when connected happens to be true.
+	connected bool
+	closeOnce sync.Once
+	app       string
+
+	outBytes          uint32
+	outMessages       chan *Message
+	outWindowSize     uint32
+	outChunkSize      uint32
+	outChunkStreamsMu sync.Mutex
+	outChunkStreams   map[uint32]*OutboundChunkStream
+
+	outQueuesMu sync.Mutex
+	outQueues   map[uint32]*outboundQueue
+	sendSignal  chan struct{}
+
+	inBytes        uint32
+	inMessages     chan *Message
+	inWindowSize   uint32
+	inChunkSize    uint32
+	inChunkStreams map[uint32]*InboundChunkStream
+
+	lastStreamId      uint32
+	lastChunkStreamId uint32
+
+	lastAckSent    uint32
+	peerAckedBytes uint32
+	sendResume     chan struct{}
+
+	// streamsMu guards streamNames/publishing: dispatchLoop owns them
+	// while the conn is alive, but Disconnect may run concurrently
+	// from sendLoop/receiveLoop on the socket's teardown path.
+	streamsMu sync.Mutex
+
+	// streamNames maps a NetStream id this conn owns to the name it
+	// was published or played under, so incoming media/commands on
+	// that stream id can be routed to the right serverStream.
+	streamNames map[uint32]string
+	publishing  map[uint32]bool
+}
+
+func newServerConn(conn net.Conn, server *Server) *ServerConn {
+	return &ServerConn{
+		server: server,
+		conn:   conn,
+
+		outMessages:     make(chan *Message, 100),
+		outChunkSize:    DEFAULT_CHUNK_SIZE,
+		outWindowSize:   DEFAULT_WINDOW_SIZE,
+		outChunkStreams: make(map[uint32]*OutboundChunkStream),
+
+		outQueues:  make(map[uint32]*outboundQueue),
+		sendSignal: make(chan struct{}, 1),
+
+		inMessages:     make(chan *Message, 100),
+		inChunkSize:    DEFAULT_CHUNK_SIZE,
+		inWindowSize:   DEFAULT_WINDOW_SIZE,
+		inChunkStreams: make(map[uint32]*InboundChunkStream),
+
+		lastChunkStreamId: CHUNK_STREAM_ID_USER_CONTROL,
+
+		sendResume: make(chan struct{}, 1),
+
+		streamNames: make(map[uint32]string),
+		publishing:  make(map[uint32]bool),
+	}
+}
+
+// handshake performs the server side of the plain (non-digest) RTMP
+// handshake: read C0/C1, reply with S0/S1/S2, then read C2. This is
+// the server-side mirror of Client's simple handshake. It always
+// answers in the plain form, with a zero S1 version, whatever version
+// the peer's C1 advertises; the complex, HMAC-signed scheme in
+// handshake.go is only used by Client.
+func (sc *ServerConn) handshake() error {
+	c0 := make([]byte, 1)
+	if _, err := io.ReadFull(sc.conn, c0); err != nil {
+		return err
+	}
+	if c0[0] != 0x03 {
+		return errors.New("rtmp: unsupported handshake version")
+	}
+
+	c1 := make([]byte, 1536)
+	if _, err := io.ReadFull(sc.conn, c1); err != nil {
+		return err
+	}
+
+	s0s1s2 := make([]byte, 1+1536+1536)
+	s0s1s2[0] = 0x03
+
+	binary.BigEndian.PutUint32(s0s1s2[1:5], 0)
+	binary.BigEndian.PutUint32(s0s1s2[5:9], 0)
+	copy(s0s1s2[1+8:1+1536], c1[8:])
+
+	copy(s0s1s2[1+1536:], c1)
+
+	if _, err := sc.conn.Write(s0s1s2); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, 1536)
+	if _, err := io.ReadFull(sc.conn, c2); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (sc *ServerConn) nextStreamId() uint32 {
+	return atomic.AddUint32(&sc.lastStreamId, 1)
+}
+
+func (sc *ServerConn) nextChunkStreamId() uint32 {
+	sc.lastChunkStreamId++
+	return sc.lastChunkStreamId
+}
+
+func (sc *ServerConn) dispatchLoop() {
+	for {
+		m := <-sc.inMessages
+
+		switch m.ChunkStreamId {
+		case CHUNK_STREAM_ID_PROTOCOL:
+			sc.handleProtocolMessage(m)
+		case CHUNK_STREAM_ID_COMMAND:
+			sc.handleCommandMessage(m)
+		default:
+			switch m.Type {
+			case MESSAGE_TYPE_AUDIO, MESSAGE_TYPE_VIDEO:
+				sc.handleMediaMessage(m)
+			}
+		}
+	}
+}
+
+func (sc *ServerConn) handleProtocolMessage(m *Message) {
+	switch m.Type {
+	case MESSAGE_TYPE_CHUNK_SIZE:
+		sc.inChunkSize = binary.BigEndian.Uint32(m.Buffer.Bytes())
+
+	case MESSAGE_TYPE_ACK:
+		acked := binary.BigEndian.Uint32(m.Buffer.Bytes())
+		log.Debug("peer acked %d bytes", acked)
+		atomic.StoreUint32(&sc.peerAckedBytes, acked)
+
+		select {
+		case sc.sendResume <- struct{}{}:
+		default:
+		}
+
+	case MESSAGE_TYPE_ACK_SIZE:
+		size := binary.BigEndian.Uint32(m.Buffer.Bytes())
+		log.Debug("setting inbound window size %d -> %d", atomic.LoadUint32(&sc.inWindowSize), size)
+		atomic.StoreUint32(&sc.inWindowSize, size)
+
+	case MESSAGE_TYPE_BANDWIDTH:
+		size := binary.BigEndian.Uint32(m.Buffer.Bytes())
+		log.Debug("setting outbound window size %d -> %d", atomic.LoadUint32(&sc.outWindowSize), size)
+		atomic.StoreUint32(&sc.outWindowSize, size)
+
+	default:
+		log.Debug("ignoring protocol message %d", m.Type)
+	}
+}
+
+// sendAck emits an Acknowledgement (type 3) protocol message carrying
+// the total bytes received so far, as required once inBytes crosses
+// inWindowSize since the last one was sent. Without it, a publishing
+// encoder that tracks its own outbound window (OBS, ffmpeg) stalls
+// once it believes it has outrun the window we advertised.
+func (sc *ServerConn) sendAck() {
+	inBytes := atomic.LoadUint32(&sc.inBytes)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, inBytes)
+
+	m := &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_PROTOCOL,
+		Type:          MESSAGE_TYPE_ACK,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
+
+	sc.outMessages <- m
+	atomic.StoreUint32(&sc.lastAckSent, inBytes)
+}
+
+// waitForSendWindow blocks the send path while the peer's advertised
+// bandwidth window would be exceeded, resuming as soon as an
+// Acknowledgement raises peerAckedBytes.
+func (sc *ServerConn) waitForSendWindow() {
+	for {
+		windowSize := atomic.LoadUint32(&sc.outWindowSize)
+		if windowSize == 0 || atomic.LoadUint32(&sc.outBytes)-atomic.LoadUint32(&sc.peerAckedBytes) < windowSize {
+			return
+		}
+		<-sc.sendResume
+	}
+}
+
+func (sc *ServerConn) handleMediaMessage(m *Message) {
+	sc.streamsMu.Lock()
+	name, ok := sc.streamNames[m.StreamId]
+	publishing := sc.publishing[m.StreamId]
+	sc.streamsMu.Unlock()
+
+	if !ok || !publishing {
+		return
+	}
+
+	sc.server.stream(name).relay(m)
+}
+
+// relayMedia re-wraps raw FLV-tag bytes for delivery on this conn's
+// subscribed stream id. The send is non-blocking: relay fans a single
+// message out to every subscriber while holding serverStream.mu, so a
+// subscriber whose outMessages is backed up (a slow reader, or one
+// that's disconnected but not yet reaped) must never block that fan-
+// out - it would stall every other subscriber and, transitively, the
+// publisher's own receiveLoop.
+func (sc *ServerConn) relayMedia(streamId uint32, typ uint8, data []byte) {
+	m := &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_USER_CONTROL + 1 + streamId,
+		Type:          typ,
+		StreamId:      streamId,
+		Length:        uint32(len(data)),
+		Buffer:        bytes.NewBuffer(append([]byte(nil), data...)),
+	}
+
+	select {
+	case sc.outMessages <- m:
+	default:
+		log.Warn("dropping relay message for slow subscriber on stream %d", streamId)
+	}
+}
+
+func (sc *ServerConn) handleCommandMessage(m *Message) {
+	r := bytes.NewReader(m.Buffer.Bytes())
+
+	name, err := amf.ReadString(r)
+	if err != nil {
+		log.Warn("unable to read command name: %v", err)
+		return
+	}
+
+	tid, err := amf.ReadDouble(r)
+	if err != nil {
+		log.Warn("unable to read command transaction id: %v", err)
+		return
+	}
+
+	switch name {
+	case "connect":
+		sc.handleConnect(tid, r)
+	case "createStream":
+		sc.handleCreateStream(tid, r)
+	case "publish":
+		sc.handlePublish(tid, m.StreamId, r)
+	case "play":
+		sc.handlePlay(tid, m.StreamId, r)
+	case "deleteStream":
+		sc.handleDeleteStream(r)
+	default:
+		log.Debug("ignoring command %s", name)
+	}
+}
+
+func (sc *ServerConn) handleConnect(tid float64, r *bytes.Reader) {
+	cmdObj, err := amf.ReadValue(r)
+	if err != nil {
+		log.Warn("unable to read connect command object: %v", err)
+		sc.conn.Close()
+		return
+	}
+
+	obj, _ := cmdObj.(amf.Object)
+	app, _ := obj["app"].(string)
+	sc.app = app
+
+	handlers, ok := sc.server.handlersFor(app)
+	if !ok || (handlers.OnConnect != nil && !handlers.OnConnect(sc, app)) {
+		log.Warn("rejecting connect to unregistered app %q", app)
+		sc.sendError(tid, "NetConnection.Connect.Rejected", "connection rejected")
+		sc.conn.Close()
+		return
+	}
+
+	sc.connected = true
+
+	buf := new(bytes.Buffer)
+	amf.WriteString(buf, "_result")
+	amf.WriteDouble(buf, tid)
+
+	props := *amf.MakeObject()
+	props["fmsVer"] = "FMS/3,0,1,123"
+	props["capabilities"] = 31
+	amf.WriteObject(buf, props)
+
+	info := *amf.MakeObject()
+	info["level"] = "status"
+	info["code"] = "NetConnection.Connect.Success"
+	info["description"] = "Connection succeeded."
+	amf.WriteObject(buf, info)
+
+	sc.sendCommand(0, buf)
+}
+
+func (sc *ServerConn) handleCreateStream(tid float64, r *bytes.Reader) {
+	id := sc.nextStreamId()
+
+	buf := new(bytes.Buffer)
+	amf.WriteString(buf, "_result")
+	amf.WriteDouble(buf, tid)
+	amf.WriteNull(buf)
+	amf.WriteDouble(buf, float64(id))
+
+	sc.sendCommand(0, buf)
+}
+
+func (sc *ServerConn) handlePublish(tid float64, streamId uint32, r *bytes.Reader) {
+	amf.ReadValue(r) // command object, always null
+
+	name, err := amf.ReadString(r)
+	if err != nil {
+		log.Warn("unable to read publish stream name: %v", err)
+		return
+	}
+
+	handlers, _ := sc.server.handlersFor(sc.app)
+	if handlers.OnPublish != nil && !handlers.OnPublish(sc, name) {
+		sc.sendStatus(streamId, "error", "NetStream.Publish.BadName", "publish rejected")
+		return
+	}
+
+	sc.streamsMu.Lock()
+	sc.streamNames[streamId] = name
+	sc.publishing[streamId] = true
+	sc.streamsMu.Unlock()
+
+	st := sc.server.stream(name)
+	st.mu.Lock()
+	st.publisher = sc
+	st.mu.Unlock()
+
+	sc.sendStatus(streamId, "status", "NetStream.Publish.Start", "publishing "+name)
+}
+
+func (sc *ServerConn) handlePlay(tid float64, streamId uint32, r *bytes.Reader) {
+	amf.ReadValue(r) // command object, always null
+
+	name, err := amf.ReadString(r)
+	if err != nil {
+		log.Warn("unable to read play stream name: %v", err)
+		return
+	}
+
+	handlers, _ := sc.server.handlersFor(sc.app)
+	if handlers.OnPlay != nil && !handlers.OnPlay(sc, name) {
+		sc.sendStatus(streamId, "error", "NetStream.Play.StreamNotFound", "play rejected")
+		return
+	}
+
+	sc.streamsMu.Lock()
+	sc.streamNames[streamId] = name
+	sc.streamsMu.Unlock()
+
+	sc.server.stream(name).addSubscriber(sc, streamId)
+
+	sc.sendStatus(streamId, "status", "NetStream.Play.Start", "playing "+name)
+}
+
+func (sc *ServerConn) handleDeleteStream(r *bytes.Reader) {
+	amf.ReadValue(r) // command object, always null
+
+	id, err := amf.ReadDouble(r)
+	if err != nil {
+		return
+	}
+
+	streamId := uint32(id)
+
+	sc.streamsMu.Lock()
+	name, ok := sc.streamNames[streamId]
+	delete(sc.streamNames, streamId)
+	delete(sc.publishing, streamId)
+	sc.streamsMu.Unlock()
+
+	if ok {
+		st := sc.server.stream(name)
+		st.removeSubscriber(sc)
+		st.removePublisher(sc)
+	}
+}
+
+func (sc *ServerConn) sendCommand(chunkStreamId uint32, buf *bytes.Buffer) {
+	if chunkStreamId == 0 {
+		chunkStreamId = CHUNK_STREAM_ID_COMMAND
+	}
+
+	sc.outMessages <- &Message{
+		ChunkStreamId: chunkStreamId,
+		Type:          MESSAGE_TYPE_AMF0,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
+}
+
+func (sc *ServerConn) sendStatus(streamId uint32, level, code, description string) {
+	buf := new(bytes.Buffer)
+	amf.WriteString(buf, "onStatus")
+	amf.WriteDouble(buf, 0)
+	amf.WriteNull(buf)
+
+	info := *amf.MakeObject()
+	info["level"] = level
+	info["code"] = code
+	info["description"] = description
+	amf.WriteObject(buf, info)
+
+	sc.outMessages <- &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_COMMAND,
+		StreamId:      streamId,
+		Type:          MESSAGE_TYPE_AMF0,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
+}
+
+func (sc *ServerConn) sendError(tid float64, code, description string) {
+	buf := new(bytes.Buffer)
+	amf.WriteString(buf, "_error")
+	amf.WriteDouble(buf, tid)
+	amf.WriteNull(buf)
+
+	info := *amf.MakeObject()
+	info["level"] = "error"
+	info["code"] = code
+	info["description"] = description
+	amf.WriteObject(buf, info)
+
+	sc.sendCommand(0, buf)
+}
+
+// receiveLoop mirrors Client.receiveLoop: reassemble chunks into
+// messages per chunk stream, honoring the four header formats.
+func (sc *ServerConn) receiveLoop() {
+	for {
+		h, err := ReadHeader(sc)
+		if err != nil {
+			sc.Disconnect()
+			return
+		}
+
+		cs := sc.inChunkStreams[h.ChunkStreamId]
+		if cs == nil {
+			cs = NewInboundChunkStream(h.ChunkStreamId)
+			sc.inChunkStreams[h.ChunkStreamId] = cs
+		}
+
+		if (cs.lastHeader == nil) && (h.Format != HEADER_FORMAT_FULL) {
+			sc.Disconnect()
+			return
+		}
+
+		var ts uint32
+		var m *Message
+
+		switch h.Format {
+		case HEADER_FORMAT_FULL:
+			cs.lastHeader = &h
+			ts = h.Timestamp
+
+		case HEADER_FORMAT_SAME_STREAM:
+			h.MessageStreamId = cs.lastHeader.MessageStreamId
+			cs.lastHeader = &h
+			ts = cs.lastInAbsoluteTimestamp + h.Timestamp
+
+		case HEADER_FORMAT_SAME_LENGTH_AND_STREAM:
+			h.MessageStreamId = cs.lastHeader.MessageStreamId
+			h.MessageLength = cs.lastHeader.MessageLength
+			h.MessageTypeId = cs.lastHeader.MessageTypeId
+			cs.lastHeader = &h
+			ts = cs.lastInAbsoluteTimestamp + h.Timestamp
+
+		case HEADER_FORMAT_CONTINUATION:
+			h.MessageStreamId = cs.lastHeader.MessageStreamId
+			h.MessageLength = cs.lastHeader.MessageLength
+			h.MessageTypeId = cs.lastHeader.MessageTypeId
+			h.Timestamp = cs.lastHeader.Timestamp
+			ts = cs.lastInAbsoluteTimestamp + cs.lastHeader.Timestamp
+
+			if cs.currentMessage != nil {
+				m = cs.currentMessage
+			}
+		}
+
+		if m == nil {
+			m = &Message{
+				Type:              h.MessageTypeId,
+				ChunkStreamId:     h.ChunkStreamId,
+				StreamId:          h.MessageStreamId,
+				Timestamp:         h.CalculateTimestamp(),
+				AbsoluteTimestamp: ts,
+				Length:            h.MessageLength,
+				Buffer:            new(bytes.Buffer),
+			}
+		}
+
+		cs.lastInAbsoluteTimestamp = ts
+
+		rs := m.RemainingBytes()
+		if rs > sc.inChunkSize {
+			rs = sc.inChunkSize
+		}
+
+		if _, err := io.CopyN(m.Buffer, sc, int64(rs)); err != nil {
+			sc.Disconnect()
+			return
+		}
+
+		if m.RemainingBytes() == 0 {
+			cs.currentMessage = nil
+			sc.inMessages <- m
+		} else {
+			cs.currentMessage = m
+		}
+	}
+}
+
+// Disconnect closes the socket and deregisters this conn from every
+// serverStream it was publishing or subscribed to. The overwhelmingly
+// common way a connection ends is a peer just closing its socket -
+// no deleteStream - so this, not handleDeleteStream, is where most
+// subscribers and publishers actually get cleaned up; skipping it
+// leaves a dead conn in serverStream.subscribers forever.
+func (sc *ServerConn) Disconnect() {
+	sc.closeOnce.Do(sc.disconnect)
+}
+
+func (sc *ServerConn) disconnect() {
+	sc.connected = false
+	sc.conn.Close()
+
+	sc.streamsMu.Lock()
+	names := sc.streamNames
+	sc.streamNames = make(map[uint32]string)
+	sc.publishing = make(map[uint32]bool)
+	sc.streamsMu.Unlock()
+
+	for _, name := range names {
+		st := sc.server.stream(name)
+		st.removeSubscriber(sc)
+		st.removePublisher(sc)
+	}
+}
+
+func (sc *ServerConn) Read(p []byte) (n int, err error) {
+	n, err = sc.conn.Read(p)
+	inBytes := atomic.AddUint32(&sc.inBytes, uint32(n))
+
+	if windowSize := atomic.LoadUint32(&sc.inWindowSize); windowSize > 0 && inBytes-atomic.LoadUint32(&sc.lastAckSent) >= windowSize {
+		sc.sendAck()
+	}
+
+	return n, err
+}
+
+func (sc *ServerConn) Write(p []byte) (n int, err error) {
+	n, err = sc.conn.Write(p)
+	atomic.AddUint32(&sc.outBytes, uint32(n))
+	return n, err
+}
@@ -0,0 +1,148 @@
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/elobuff/goamf"
+)
+
+// NetStream represents a single createStream()'d stream on a
+// connection, the unit publish()/play() operate against. Most callers
+// only ever need one of these per Client.
+type NetStream struct {
+	c    *Client
+	id   uint32
+	name string
+
+	chunkStreamId uint32
+}
+
+// CreateStream allocates a new NetStream, the prerequisite for any
+// Publish or Play call, mirroring the NetConnection.createStream
+// handshake issued by Flash/AS3 clients and by OBS/FFmpeg.
+func (c *Client) CreateStream() (*NetStream, error) {
+	values, err := c.CallTimeout("createStream", DefaultCommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("rtmp: createStream _result missing stream id")
+	}
+
+	id, ok := values[len(values)-1].(float64)
+	if !ok {
+		return nil, fmt.Errorf("rtmp: createStream _result stream id was %T, not a number", values[len(values)-1])
+	}
+
+	s := &NetStream{
+		c:             c,
+		id:            uint32(id),
+		chunkStreamId: c.nextChunkStreamId(),
+	}
+	c.streams[s.id] = s
+
+	return s, nil
+}
+
+// command fires a NetStream-scoped command without waiting for a
+// reply; publish/play/deleteStream completion is signalled later via
+// onStatus, not a _result.
+func (s *NetStream) command(name string, args ...interface{}) {
+	buf := new(bytes.Buffer)
+
+	amf.WriteString(buf, name)
+	amf.WriteDouble(buf, float64(s.c.NextTransactionId()))
+	amf.WriteNull(buf)
+
+	for _, a := range args {
+		writeAMFValue(buf, a)
+	}
+
+	m := &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_COMMAND,
+		StreamId:      s.id,
+		Type:          MESSAGE_TYPE_AMF0,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
+
+	s.c.outMessages <- m
+}
+
+// Publish begins publishing live media under name, equivalent to
+// NetStream.publish(name, "live").
+func (s *NetStream) Publish(name string) {
+	s.name = name
+	s.command("publish", name, "live")
+}
+
+// Play requests playback of name from the peer, equivalent to
+// NetStream.play(name). Demuxed media arrives via Client.ReadPacket.
+func (s *NetStream) Play(name string) {
+	s.name = name
+	s.command("play", name)
+}
+
+// DeleteStream releases the stream, equivalent to
+// NetConnection.call("deleteStream", null, streamId).
+func (s *NetStream) DeleteStream() {
+	buf := new(bytes.Buffer)
+
+	amf.WriteString(buf, "deleteStream")
+	amf.WriteDouble(buf, float64(s.c.NextTransactionId()))
+	amf.WriteNull(buf)
+	amf.WriteDouble(buf, float64(s.id))
+
+	m := &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_COMMAND,
+		Type:          MESSAGE_TYPE_AMF0,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
+
+	s.c.outMessages <- m
+
+	delete(s.c.streams, s.id)
+}
+
+// FCPublish is the legacy NetConnection-level RPC that FMS/Wowza and
+// relays such as OBS still issue ahead of createStream/publish.
+func (c *Client) FCPublish(name string) {
+	c.netConnectionCall("FCPublish", name)
+}
+
+// FCUnpublish is the counterpart to FCPublish, issued when a publisher
+// stops streaming.
+func (c *Client) FCUnpublish(name string) {
+	c.netConnectionCall("FCUnpublish", name)
+}
+
+func (c *Client) netConnectionCall(name string, arg string) {
+	buf := new(bytes.Buffer)
+
+	amf.WriteString(buf, name)
+	amf.WriteDouble(buf, float64(c.NextTransactionId()))
+	amf.WriteNull(buf)
+	amf.WriteString(buf, arg)
+
+	m := &Message{
+		ChunkStreamId: CHUNK_STREAM_ID_COMMAND,
+		Type:          MESSAGE_TYPE_AMF0,
+		Length:        uint32(buf.Len()),
+		Buffer:        buf,
+	}
+
+	c.outMessages <- m
+}
+
+// nextChunkStreamId hands out chunk stream ids for media, starting
+// past the protocol/command/user-control ids reserved in const.go.
+func (c *Client) nextChunkStreamId() uint32 {
+	c.lastChunkStreamId++
+	if c.lastChunkStreamId < CHUNK_STREAM_ID_USER_CONTROL+1 {
+		c.lastChunkStreamId = CHUNK_STREAM_ID_USER_CONTROL + 1
+	}
+	return c.lastChunkStreamId
+}